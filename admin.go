@@ -0,0 +1,570 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed admin_ui/*.html
+var adminUI embed.FS
+
+var adminUITemplate = template.Must(template.ParseFS(adminUI, "admin_ui/*.html"))
+
+// adminKeyRecord is how the admin API remembers a key it issued: the policy
+// (with Key blanked out) plus the hash admin mutations key off of. The
+// plaintext key is never retained past the response that handed it out.
+type adminKeyRecord struct {
+	ID         string
+	KeyHash    string
+	VirtualKey VirtualKey
+	CreatedAt  time.Time
+	RotatedAt  time.Time
+}
+
+// adminStore is a KeyStore that also supports issuing, revoking, and
+// rotating keys at runtime, backing the admin HTTP API and UI. It only
+// makes sense as an in-memory store: file and redis key stores are managed
+// externally, outside this process.
+type adminStore struct {
+	knownUpstreamAccounts map[string]struct{}
+
+	mu      sync.RWMutex
+	byID    map[string]*adminKeyRecord
+	byHash  map[string]*adminKeyRecord
+	changes *changeSet
+}
+
+// newAdminStore seeds the store from the static virtual_keys list.
+// knownUpstreamAccounts is the set of upstream_accounts configured in the
+// config file; keys created or rotated later through the admin API are
+// validated against it the same way the static config is at startup.
+func newAdminStore(seed []VirtualKey, knownUpstreamAccounts map[string]struct{}) *adminStore {
+	s := &adminStore{
+		knownUpstreamAccounts: knownUpstreamAccounts,
+		byID:                  make(map[string]*adminKeyRecord),
+		byHash:                make(map[string]*adminKeyRecord),
+		changes:               newChangeSet(),
+	}
+	for _, vk := range seed {
+		rec := &adminKeyRecord{
+			ID:         generateAdminID(),
+			KeyHash:    hashKey(vk.Key),
+			VirtualKey: vk,
+			CreatedAt:  time.Now(),
+		}
+		rec.VirtualKey.Key = ""
+		s.byID[rec.ID] = rec
+		s.byHash[rec.KeyHash] = rec
+	}
+	return s
+}
+
+// validateUpstreamAccount fails with errUnknownUpstreamAccount if name is
+// non-empty and isn't one of knownUpstreamAccounts.
+func (s *adminStore) validateUpstreamAccount(name string) error {
+	if name == "" {
+		return nil
+	}
+	if _, ok := s.knownUpstreamAccounts[name]; !ok {
+		return fmt.Errorf("%w: %q", errUnknownUpstreamAccount, name)
+	}
+	return nil
+}
+
+func (s *adminStore) Lookup(keyHash string) (VirtualKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rec, ok := s.byHash[keyHash]
+	if !ok {
+		return VirtualKey{}, false
+	}
+	return rec.VirtualKey, true
+}
+
+func (s *adminStore) Watch(ctx context.Context) <-chan struct{} {
+	return s.changes.signal
+}
+
+func (s *adminStore) Drain() (hashes []string, all bool) {
+	return s.changes.drain()
+}
+
+// notify reports that keyHash's policy changed, so the policyRegistry can
+// evict just that entry. An empty keyHash flushes every cached entry.
+func (s *adminStore) notify(keyHash string) {
+	s.changes.markChanged(keyHash)
+}
+
+// Create issues a new virtual key, returning its plaintext (shown to the
+// caller exactly once) and the record stored in its place.
+func (s *adminStore) Create(policy VirtualKey) (plaintext string, rec adminKeyRecord, err error) {
+	if err := s.validateUpstreamAccount(policy.UpstreamAccount); err != nil {
+		return "", adminKeyRecord{}, err
+	}
+
+	plaintext, err = generateAdminSecret()
+	if err != nil {
+		return "", adminKeyRecord{}, err
+	}
+	policy.Key = ""
+
+	r := &adminKeyRecord{
+		ID:         generateAdminID(),
+		KeyHash:    hashKey(plaintext),
+		VirtualKey: policy,
+		CreatedAt:  time.Now(),
+	}
+
+	s.mu.Lock()
+	s.byID[r.ID] = r
+	s.byHash[r.KeyHash] = r
+	s.mu.Unlock()
+	s.notify(r.KeyHash)
+
+	return plaintext, *r, nil
+}
+
+// Delete revokes the key with id, reporting whether it existed.
+func (s *adminStore) Delete(id string) bool {
+	s.mu.Lock()
+	rec, ok := s.byID[id]
+	if ok {
+		delete(s.byID, id)
+		delete(s.byHash, rec.KeyHash)
+	}
+	s.mu.Unlock()
+
+	if ok {
+		s.notify(rec.KeyHash)
+	}
+	return ok
+}
+
+// Rotate replaces the plaintext key behind id with a freshly generated one,
+// keeping the rest of its policy, and returns the new plaintext.
+func (s *adminStore) Rotate(id string) (plaintext string, ok bool, err error) {
+	plaintext, err = generateAdminSecret()
+	if err != nil {
+		return "", false, err
+	}
+
+	s.mu.Lock()
+	rec, found := s.byID[id]
+	var oldHash string
+	if found {
+		oldHash = rec.KeyHash
+		delete(s.byHash, rec.KeyHash)
+		rec.KeyHash = hashKey(plaintext)
+		rec.RotatedAt = time.Now()
+		s.byHash[rec.KeyHash] = rec
+	}
+	s.mu.Unlock()
+
+	if !found {
+		return "", false, nil
+	}
+	// Evict the old hash so the previous key stops resolving immediately,
+	// instead of continuing to work off a stale policyRegistry cache entry
+	// until the next unrelated change flushes it.
+	s.notify(oldHash)
+	return plaintext, true, nil
+}
+
+// List returns every issued key, sorted by name, for the admin API and UI.
+func (s *adminStore) List() []adminKeyRecord {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	recs := make([]adminKeyRecord, 0, len(s.byID))
+	for _, rec := range s.byID {
+		recs = append(recs, *rec)
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].VirtualKey.Name < recs[j].VirtualKey.Name })
+	return recs
+}
+
+func generateAdminID() string {
+	b, err := randomHex(8)
+	if err != nil {
+		// crypto/rand failing means the system is broken; there's nothing
+		// sane to fall back to.
+		panic(err)
+	}
+	return "key_" + b
+}
+
+func generateAdminSecret() (string, error) {
+	b, err := randomHex(24)
+	if err != nil {
+		return "", err
+	}
+	return "sk-maxmux-" + b, nil
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generating random bytes: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// adminServer wires the admin JSON API and embedded UI on top of an
+// adminStore, the policyRegistry it backs (for per-key usage history), and
+// the shared Metrics registry (for aggregate usage stats).
+type adminServer struct {
+	store    *adminStore
+	policies *policyRegistry
+	metrics  *Metrics
+}
+
+// Handler returns the admin mux, gated by sharedSecret if set.
+func (a *adminServer) Handler(sharedSecret string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/keys", a.handleKeys)
+	mux.HandleFunc("/admin/keys/", a.handleKeyByID)
+	mux.HandleFunc("/admin/usage", a.handleUsage)
+	mux.Handle("/admin/ui", http.RedirectHandler("/admin/ui/", http.StatusMovedPermanently))
+	mux.HandleFunc("/admin/ui/", a.handleUI)
+	mux.HandleFunc("/admin/ui/keys", a.handleUICreateKey)
+	mux.HandleFunc("/admin/ui/keys/", a.handleUIKeyByID)
+	return adminAuthMiddleware(sharedSecret, mux)
+}
+
+// adminAuthMiddleware requires secret as either a Bearer token (for the JSON
+// API) or HTTP Basic Auth password (for browsers hitting the UI). An empty
+// secret disables auth, e.g. when the listener is already behind mTLS.
+func adminAuthMiddleware(secret string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if secret == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+		} else if _, pass, ok := r.BasicAuth(); ok && subtle.ConstantTimeCompare([]byte(pass), []byte(secret)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="maxmux admin"`)
+		writeAdminError(w, http.StatusUnauthorized, "unauthorized")
+	})
+}
+
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]string{"message": message, "type": "invalid_request_error"},
+	})
+}
+
+func (a *adminServer) handleKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		a.createKey(w, r)
+	case http.MethodGet:
+		a.listKeys(w, r)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (a *adminServer) createKey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name                   string   `json:"name"`
+		UpstreamAccount        string   `json:"upstream_account"`
+		AllowedModels          []string `json:"allowed_models"`
+		RequestsPerMinute      int      `json:"requests_per_minute"`
+		DailyTokenBudget       int      `json:"daily_token_budget"`
+		RequiredClientIdentity string   `json:"required_client_identity"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	plaintext, rec, err := a.store.Create(VirtualKey{
+		Name:                   req.Name,
+		UpstreamAccount:        req.UpstreamAccount,
+		AllowedModels:          req.AllowedModels,
+		RequestsPerMinute:      req.RequestsPerMinute,
+		DailyTokenBudget:       req.DailyTokenBudget,
+		RequiredClientIdentity: req.RequiredClientIdentity,
+	})
+	if errors.Is(err, errUnknownUpstreamAccount) {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, "failed to issue key")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]any{
+		"id":   rec.ID,
+		"key":  plaintext,
+		"name": rec.VirtualKey.Name,
+	})
+}
+
+func (a *adminServer) listKeys(w http.ResponseWriter, r *http.Request) {
+	recs := a.store.List()
+	views := make([]map[string]any, 0, len(recs))
+	for _, rec := range recs {
+		input, output := a.metrics.TokensUsedFor(rec.VirtualKey.Name)
+		views = append(views, map[string]any{
+			"id":                  rec.ID,
+			"name":                rec.VirtualKey.Name,
+			"upstream_account":    rec.VirtualKey.UpstreamAccount,
+			"allowed_models":      rec.VirtualKey.AllowedModels,
+			"requests_per_minute": rec.VirtualKey.RequestsPerMinute,
+			"daily_token_budget":  rec.VirtualKey.DailyTokenBudget,
+			"created_at":          rec.CreatedAt,
+			"rotated_at":          rec.RotatedAt,
+			"tokens_used_input":   input,
+			"tokens_used_output":  output,
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"keys": views})
+}
+
+func (a *adminServer) handleKeyByID(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/admin/keys/")
+	if rest == "" {
+		writeAdminError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	if id, ok := strings.CutSuffix(rest, "/rotate"); ok {
+		if r.Method != http.MethodPost {
+			writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		a.rotateKey(w, id)
+		return
+	}
+
+	if r.Method != http.MethodDelete {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	a.revokeKey(w, rest)
+}
+
+func (a *adminServer) rotateKey(w http.ResponseWriter, id string) {
+	plaintext, ok, err := a.store.Rotate(id)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, "failed to rotate key")
+		return
+	}
+	if !ok {
+		writeAdminError(w, http.StatusNotFound, "no such key")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"id": id, "key": plaintext})
+}
+
+func (a *adminServer) revokeKey(w http.ResponseWriter, id string) {
+	if !a.store.Delete(id) {
+		writeAdminError(w, http.StatusNotFound, "no such key")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminServer) handleUsage(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if s := r.URL.Query().Get("since"); s != "" {
+		parsed, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, "since must be RFC3339")
+			return
+		}
+		since = parsed
+	} else {
+		since = time.Now().UTC().AddDate(0, 0, -(usageHistoryDays - 1))
+	}
+
+	type keyUsage struct {
+		ID     string `json:"id"`
+		Name   string `json:"name"`
+		Tokens int    `json:"tokens"`
+	}
+	usages := make([]keyUsage, 0)
+	for _, rec := range a.store.List() {
+		state, ok := a.policies.Lookup(rec.KeyHash)
+		if !ok {
+			continue
+		}
+		total := 0
+		history := state.usageHistory()
+		for i, tokens := range history {
+			day := time.Now().UTC().AddDate(0, 0, -(len(history) - 1 - i))
+			if !day.Before(since) {
+				total += tokens
+			}
+		}
+		usages = append(usages, keyUsage{ID: rec.ID, Name: rec.VirtualKey.Name, Tokens: total})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"since": since.Format(time.RFC3339),
+		"keys":  usages,
+	})
+}
+
+// sparklineMaxHeight is the tallest a sparkline bar can render, in pixels.
+const sparklineMaxHeight = 24
+
+// adminUIKeyView is what the embedded template renders per key.
+type adminUIKeyView struct {
+	ID      string
+	Name    string
+	Account string
+	Budget  int
+	Used    []int // per-day bar heights in pixels, scaled to this key's own peak
+}
+
+func (a *adminServer) handleUI(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/admin/ui/" {
+		http.NotFound(w, r)
+		return
+	}
+	a.renderUI(w)
+}
+
+func (a *adminServer) renderUI(w http.ResponseWriter) {
+	recs := a.store.List()
+	views := make([]adminUIKeyView, 0, len(recs))
+	for _, rec := range recs {
+		var history []int
+		if state, ok := a.policies.Lookup(rec.KeyHash); ok {
+			history = state.usageHistory()
+		} else {
+			history = make([]int, usageHistoryDays)
+		}
+		views = append(views, adminUIKeyView{
+			ID:      rec.ID,
+			Name:    rec.VirtualKey.Name,
+			Account: rec.VirtualKey.UpstreamAccount,
+			Budget:  rec.VirtualKey.DailyTokenBudget,
+			Used:    sparklineHeights(history),
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := adminUITemplate.ExecuteTemplate(w, "index.html", map[string]any{"Keys": views}); err != nil {
+		writeAdminError(w, http.StatusInternalServerError, "failed to render UI")
+	}
+}
+
+// sparklineHeights scales daily token totals to pixel heights (1..24, or 0
+// for a day with no usage) relative to the highest day in the window.
+func sparklineHeights(history []int) []int {
+	max := 0
+	for _, v := range history {
+		if v > max {
+			max = v
+		}
+	}
+	heights := make([]int, len(history))
+	for i, v := range history {
+		if max == 0 || v == 0 {
+			heights[i] = 0
+			continue
+		}
+		heights[i] = 1 + (v*(sparklineMaxHeight-1))/max
+	}
+	return heights
+}
+
+// handleUICreateKey backs the UI's "create key" form, which HTMX submits as
+// application/x-www-form-urlencoded. It re-renders the full page afterward
+// so the new key shows up in the table (its plaintext is only ever shown
+// through the JSON API's response, never through the UI).
+func (a *adminServer) handleUICreateKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "invalid form body")
+		return
+	}
+
+	var allowedModels []string
+	if raw := r.FormValue("allowed_models"); raw != "" {
+		for _, m := range strings.Split(raw, ",") {
+			if m = strings.TrimSpace(m); m != "" {
+				allowedModels = append(allowedModels, m)
+			}
+		}
+	}
+	requestsPerMinute, _ := strconv.Atoi(r.FormValue("requests_per_minute"))
+	dailyTokenBudget, _ := strconv.Atoi(r.FormValue("daily_token_budget"))
+
+	if _, _, err := a.store.Create(VirtualKey{
+		Name:              r.FormValue("name"),
+		UpstreamAccount:   r.FormValue("upstream_account"),
+		AllowedModels:     allowedModels,
+		RequestsPerMinute: requestsPerMinute,
+		DailyTokenBudget:  dailyTokenBudget,
+	}); err != nil {
+		if errors.Is(err, errUnknownUpstreamAccount) {
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeAdminError(w, http.StatusInternalServerError, "failed to issue key")
+		return
+	}
+
+	a.renderUI(w)
+}
+
+// handleUIKeyByID backs the UI's per-row revoke/rotate buttons, which HTMX
+// drives as plain DELETE/POST requests against these UI-scoped paths so the
+// response can be the re-rendered page rather than JSON.
+func (a *adminServer) handleUIKeyByID(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/admin/ui/keys/")
+
+	if id, ok := strings.CutSuffix(rest, "/rotate"); ok && r.Method == http.MethodPost {
+		if _, _, err := a.store.Rotate(id); err != nil {
+			writeAdminError(w, http.StatusInternalServerError, "failed to rotate key")
+			return
+		}
+		a.renderUI(w)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		a.store.Delete(rest)
+		a.renderUI(w)
+		return
+	}
+
+	writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
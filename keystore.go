@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+)
+
+// hashKey returns the SHA-256 hex digest of a raw virtual key. Every
+// KeyStore indexes by this hash so raw keys never need to be stored
+// server-side.
+func hashKey(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// KeyStore resolves a hashed virtual key to its policy and can signal when
+// the underlying key set changes, so keys can be issued or revoked without
+// a restart.
+type KeyStore interface {
+	// Lookup returns the policy for keyHash (the SHA-256 hex digest of the
+	// bearer token), or ok=false if no such key is known.
+	Lookup(keyHash string) (VirtualKey, bool)
+
+	// Watch returns a channel that's pinged whenever Drain has something new
+	// to report. The ping itself carries no information — it may coalesce
+	// several changes into one wakeup — so the caller must call Drain after
+	// every receive to find out what actually changed. The channel is
+	// closed once ctx is done.
+	Watch(ctx context.Context) <-chan struct{}
+
+	// Drain returns every key hash that changed since the last call to
+	// Drain (so a cache in front of this store can evict exactly those
+	// entries), or all=true if the whole key set may have changed (e.g. a
+	// bulk file reload) and any cache should be flushed entirely.
+	Drain() (hashes []string, all bool)
+}
+
+// changeSet accumulates changed key hashes behind a mutex and pings a
+// buffered signal channel to wake a watcher. Unlike sending the hash itself
+// down a bounded channel, a change is never lost to a full buffer: the data
+// lives in the set, not in the channel, and the channel only has to
+// guarantee that at least one more Drain happens after every markChanged.
+type changeSet struct {
+	mu      sync.Mutex
+	pending map[string]struct{}
+	all     bool
+	signal  chan struct{}
+}
+
+func newChangeSet() *changeSet {
+	return &changeSet{pending: make(map[string]struct{}), signal: make(chan struct{}, 1)}
+}
+
+// markChanged records hash as changed, or, if hash is "", that the entire
+// key set may have changed, and wakes the watcher.
+func (c *changeSet) markChanged(hash string) {
+	c.mu.Lock()
+	if hash == "" {
+		c.all = true
+		c.pending = make(map[string]struct{})
+	} else if !c.all {
+		c.pending[hash] = struct{}{}
+	}
+	c.mu.Unlock()
+
+	select {
+	case c.signal <- struct{}{}:
+	default:
+	}
+}
+
+// drain returns (and clears) everything accumulated since the last drain.
+func (c *changeSet) drain() (hashes []string, all bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.all {
+		c.all = false
+		return nil, true
+	}
+	if len(c.pending) == 0 {
+		return nil, false
+	}
+	hashes = make([]string, 0, len(c.pending))
+	for hash := range c.pending {
+		hashes = append(hashes, hash)
+	}
+	c.pending = make(map[string]struct{})
+	return hashes, false
+}
+
+// errUnknownUpstreamAccount is returned when a VirtualKey names an
+// upstream_account that isn't configured, so callers can tell it apart from
+// unrelated failures (e.g. map it to a 400 instead of a 500 in the admin
+// API).
+var errUnknownUpstreamAccount = errors.New("unknown upstream_account")
+
+// validateUpstreamAccounts fails fast if any vk names an upstream_account
+// that isn't present in accounts, rather than letting it surface later as a
+// per-request "no token source for upstream account" proxy error.
+func validateUpstreamAccounts(vks []VirtualKey, accounts map[string]UpstreamAccount) error {
+	for _, vk := range vks {
+		if vk.UpstreamAccount == "" {
+			continue
+		}
+		if _, ok := accounts[vk.UpstreamAccount]; !ok {
+			return fmt.Errorf("%w: virtual key %q references upstream_account %q", errUnknownUpstreamAccount, vk.Name, vk.UpstreamAccount)
+		}
+	}
+	return nil
+}
+
+// newKeyStore builds the KeyStore implementation selected by cfg.KeyStore.
+// If cfg.AdminAddr is set, the admin API needs to mutate the key set at
+// runtime, so it requires (and gets) the in-memory adminStore rather than
+// the plain static map — file and redis stores are managed externally and
+// don't implement the admin mutation methods.
+func newKeyStore(ctx context.Context, cfg *Config, configPath string, log zerolog.Logger) (KeyStore, error) {
+	switch cfg.KeyStore.Type {
+	case "", "static":
+		if err := validateUpstreamAccounts(cfg.VirtualKeys, cfg.UpstreamAccounts); err != nil {
+			return nil, err
+		}
+		if cfg.AdminAddr != "" {
+			knownUpstreamAccounts := make(map[string]struct{}, len(cfg.UpstreamAccounts))
+			for name := range cfg.UpstreamAccounts {
+				knownUpstreamAccounts[name] = struct{}{}
+			}
+			return newAdminStore(cfg.VirtualKeys, knownUpstreamAccounts), nil
+		}
+		return newStaticKeyStore(cfg.VirtualKeys), nil
+	case "file":
+		if cfg.AdminAddr != "" {
+			return nil, fmt.Errorf("admin_addr requires key_store.type \"static\" (or unset)")
+		}
+		return newFileKeyStore(ctx, configPath, log)
+	case "redis":
+		if cfg.AdminAddr != "" {
+			return nil, fmt.Errorf("admin_addr requires key_store.type \"static\" (or unset)")
+		}
+		return newRedisKeyStore(ctx, cfg.KeyStore.Redis, log), nil
+	default:
+		return nil, fmt.Errorf("unknown key_store.type %q", cfg.KeyStore.Type)
+	}
+}
+
+func defaultKeyStoreType(t string) string {
+	if t == "" {
+		return "static"
+	}
+	return t
+}
+
+// staticKeyStore is today's YAML-at-startup behavior: the virtual_keys list
+// loaded once and never updated.
+type staticKeyStore struct {
+	keys map[string]VirtualKey
+}
+
+func newStaticKeyStore(vks []VirtualKey) *staticKeyStore {
+	keys := make(map[string]VirtualKey, len(vks))
+	for _, vk := range vks {
+		keys[hashKey(vk.Key)] = vk
+	}
+	return &staticKeyStore{keys: keys}
+}
+
+func (s *staticKeyStore) Lookup(keyHash string) (VirtualKey, bool) {
+	vk, ok := s.keys[keyHash]
+	return vk, ok
+}
+
+func (s *staticKeyStore) Watch(ctx context.Context) <-chan struct{} {
+	ch := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		close(ch)
+	}()
+	return ch
+}
+
+func (s *staticKeyStore) Drain() (hashes []string, all bool) {
+	return nil, false
+}
+
+// fileKeyStore re-reads its YAML config on SIGHUP and whenever the file
+// changes on disk, atomically swapping in the new key map so a lookup never
+// observes a partially-updated set.
+type fileKeyStore struct {
+	path string
+	log  zerolog.Logger
+
+	keys    atomic.Pointer[map[string]VirtualKey]
+	changes *changeSet
+}
+
+func newFileKeyStore(ctx context.Context, path string, log zerolog.Logger) (*fileKeyStore, error) {
+	s := &fileKeyStore{path: path, log: log, changes: newChangeSet()}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	go s.watchSignals(ctx)
+	go s.watchFile(ctx)
+	return s, nil
+}
+
+func (s *fileKeyStore) reload() error {
+	cfg, err := loadConfig(s.path)
+	if err != nil {
+		return fmt.Errorf("reloading key store config: %w", err)
+	}
+	if err := validateUpstreamAccounts(cfg.VirtualKeys, cfg.UpstreamAccounts); err != nil {
+		return fmt.Errorf("reloading key store config: %w", err)
+	}
+	keys := make(map[string]VirtualKey, len(cfg.VirtualKeys))
+	for _, vk := range cfg.VirtualKeys {
+		keys[hashKey(vk.Key)] = vk
+	}
+
+	var old map[string]VirtualKey
+	if p := s.keys.Load(); p != nil {
+		old = *p
+	}
+	s.keys.Store(&keys)
+
+	for _, hash := range changedKeyHashes(old, keys) {
+		s.changes.markChanged(hash)
+	}
+	s.log.Info().Int("virtual_keys", len(keys)).Msg("reloaded virtual keys from file")
+	return nil
+}
+
+func (s *fileKeyStore) Lookup(keyHash string) (VirtualKey, bool) {
+	vk, ok := (*s.keys.Load())[keyHash]
+	return vk, ok
+}
+
+func (s *fileKeyStore) Watch(ctx context.Context) <-chan struct{} {
+	return s.changes.signal
+}
+
+func (s *fileKeyStore) Drain() (hashes []string, all bool) {
+	return s.changes.drain()
+}
+
+// changedKeyHashes compares two key hash maps and returns the hashes whose
+// policy was added, removed, or edited, so a reload only invalidates the
+// entries that actually changed.
+func changedKeyHashes(old, new map[string]VirtualKey) []string {
+	var hashes []string
+	for hash, vk := range new {
+		if prev, ok := old[hash]; !ok || !reflect.DeepEqual(prev, vk) {
+			hashes = append(hashes, hash)
+		}
+	}
+	for hash := range old {
+		if _, ok := new[hash]; !ok {
+			hashes = append(hashes, hash)
+		}
+	}
+	return hashes
+}
+
+func (s *fileKeyStore) watchSignals(ctx context.Context) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sighup:
+			if err := s.reload(); err != nil {
+				s.log.Error().Err(err).Msg("failed to reload virtual keys on SIGHUP")
+			}
+		}
+	}
+}
+
+func (s *fileKeyStore) watchFile(ctx context.Context) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		s.log.Error().Err(err).Msg("failed to start file watcher for virtual keys")
+		return
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(s.path); err != nil {
+		s.log.Error().Err(err).Str("path", s.path).Msg("failed to watch config file")
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			if err := s.reload(); err != nil {
+				s.log.Error().Err(err).Msg("failed to reload virtual keys after file change")
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			s.log.Error().Err(err).Msg("file watcher error")
+		}
+	}
+}
+
+// redisKeyStore looks up per-key policy blobs stored at "<key_prefix><hash>"
+// in Redis, caching hits for cacheTTL, and drops cached entries when
+// notified of a revocation/rotation on pubsubChannel.
+type redisKeyStore struct {
+	client    *redis.Client
+	log       zerolog.Logger
+	keyPrefix string
+	cacheTTL  time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedKey
+
+	changes *changeSet
+}
+
+type cachedKey struct {
+	policy    VirtualKey
+	ok        bool
+	expiresAt time.Time
+}
+
+func newRedisKeyStore(ctx context.Context, cfg RedisKeyStoreConfig, log zerolog.Logger) *redisKeyStore {
+	ttl := cfg.CacheTTL
+	if ttl <= 0 {
+		ttl = 5 * time.Second
+	}
+	prefix := cfg.KeyPrefix
+	if prefix == "" {
+		prefix = "maxmux:key:"
+	}
+
+	s := &redisKeyStore{
+		client: redis.NewClient(&redis.Options{
+			Addr:     cfg.Addr,
+			Password: cfg.Password,
+			DB:       cfg.DB,
+		}),
+		log:       log,
+		keyPrefix: prefix,
+		cacheTTL:  ttl,
+		cache:     make(map[string]cachedKey),
+		changes:   newChangeSet(),
+	}
+
+	if cfg.PubSubChannel != "" {
+		go s.subscribe(ctx, cfg.PubSubChannel)
+	}
+
+	return s
+}
+
+func (s *redisKeyStore) Lookup(keyHash string) (VirtualKey, bool) {
+	s.mu.Lock()
+	if entry, ok := s.cache[keyHash]; ok && time.Now().Before(entry.expiresAt) {
+		s.mu.Unlock()
+		return entry.policy, entry.ok
+	}
+	s.mu.Unlock()
+
+	data, err := s.client.Get(context.Background(), s.keyPrefix+keyHash).Bytes()
+	if err != nil && err != redis.Nil {
+		s.log.Error().Err(err).Msg("redis key lookup failed")
+		return VirtualKey{}, false
+	}
+
+	var vk VirtualKey
+	ok := err == nil
+	if ok {
+		if err := json.Unmarshal(data, &vk); err != nil {
+			s.log.Error().Err(err).Msg("failed to parse redis key policy")
+			ok = false
+		}
+	}
+
+	s.mu.Lock()
+	s.cache[keyHash] = cachedKey{policy: vk, ok: ok, expiresAt: time.Now().Add(s.cacheTTL)}
+	s.mu.Unlock()
+
+	return vk, ok
+}
+
+func (s *redisKeyStore) Watch(ctx context.Context) <-chan struct{} {
+	return s.changes.signal
+}
+
+func (s *redisKeyStore) Drain() (hashes []string, all bool) {
+	return s.changes.drain()
+}
+
+// subscribe drops cached entries as revocations/rotations are announced.
+// Payload is the affected key hash, or empty to flush the whole cache.
+func (s *redisKeyStore) subscribe(ctx context.Context, channel string) {
+	sub := s.client.Subscribe(ctx, channel)
+	defer sub.Close()
+
+	for {
+		msg, err := sub.ReceiveMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			s.log.Error().Err(err).Msg("redis pubsub receive failed")
+			time.Sleep(time.Second)
+			continue
+		}
+
+		s.mu.Lock()
+		if msg.Payload == "" {
+			s.cache = make(map[string]cachedKey)
+		} else {
+			delete(s.cache, msg.Payload)
+		}
+		s.mu.Unlock()
+
+		s.changes.markChanged(msg.Payload)
+	}
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,10 +20,79 @@ import (
 )
 
 type Config struct {
-	Port        int      `yaml:"port"`
-	Upstream    string   `yaml:"upstream"`
-	OAuthToken  string   `yaml:"oauth_token"`
-	VirtualKeys []string `yaml:"virtual_keys"`
+	Port           int    `yaml:"port"`
+	Upstream       string `yaml:"upstream"`
+	PrometheusAddr string `yaml:"prometheus_addr"`
+
+	// AdminAddr, if set, starts the admin HTTP API and embedded web UI for
+	// virtual-key lifecycle management on their own listener. Requires
+	// key_store.type to be "static" (or unset). This endpoint can mint,
+	// list, rotate, and revoke credentials, so it should be protected by
+	// AdminSharedSecret and/or AdminTLS (ideally with client_auth requiring
+	// mTLS) in any deployment that isn't fully trusted localhost.
+	AdminAddr         string    `yaml:"admin_addr"`
+	AdminSharedSecret string    `yaml:"admin_shared_secret"`
+	AdminTLS          TLSConfig `yaml:"admin_tls"`
+
+	// RedactSystemPrompts, if true, strips the request body's "system" field
+	// before it's written to the debug log, so sensitive prompts don't end
+	// up in log aggregators.
+	RedactSystemPrompts bool `yaml:"redact_system_prompts"`
+
+	OAuthToken    string    `yaml:"oauth_token"`
+	RefreshToken  string    `yaml:"refresh_token"`
+	ClientID      string    `yaml:"client_id"`
+	TokenEndpoint string    `yaml:"token_endpoint"`
+	ExpiresAt     time.Time `yaml:"expires_at"`
+
+	UpstreamAccounts map[string]UpstreamAccount `yaml:"upstream_accounts"`
+	VirtualKeys      []VirtualKey               `yaml:"virtual_keys"`
+
+	KeyStore KeyStoreConfig `yaml:"key_store"`
+	TLS      TLSConfig      `yaml:"tls"`
+}
+
+// KeyStoreConfig selects and configures how virtual keys are resolved: the
+// static virtual_keys list (default), a watched config file, or Redis.
+type KeyStoreConfig struct {
+	Type  string              `yaml:"type"` // "static" (default), "file", or "redis"
+	Redis RedisKeyStoreConfig `yaml:"redis"`
+}
+
+// RedisKeyStoreConfig configures the "redis" KeyStore implementation.
+type RedisKeyStoreConfig struct {
+	Addr          string        `yaml:"addr"`
+	Password      string        `yaml:"password"`
+	DB            int           `yaml:"db"`
+	KeyPrefix     string        `yaml:"key_prefix"`
+	PubSubChannel string        `yaml:"pubsub_channel"`
+	CacheTTL      time.Duration `yaml:"cache_ttl"`
+}
+
+// UpstreamAccount is a named set of Anthropic OAuth credentials a VirtualKey
+// can be mapped to, so different tenants can be billed against different
+// upstream accounts.
+type UpstreamAccount struct {
+	OAuthToken    string    `yaml:"oauth_token"`
+	RefreshToken  string    `yaml:"refresh_token"`
+	ClientID      string    `yaml:"client_id"`
+	TokenEndpoint string    `yaml:"token_endpoint"`
+	ExpiresAt     time.Time `yaml:"expires_at"`
+}
+
+// VirtualKey is a client-facing API key and the policy enforced for it.
+type VirtualKey struct {
+	Key               string   `yaml:"key"`
+	Name              string   `yaml:"name"`
+	UpstreamAccount   string   `yaml:"upstream_account"`
+	AllowedModels     []string `yaml:"allowed_models"`
+	RequestsPerMinute int      `yaml:"requests_per_minute"`
+	DailyTokenBudget  int      `yaml:"daily_token_budget"`
+
+	// RequiredClientIdentity, if set, pins this key to an mTLS client
+	// certificate: either a SPIFFE "spiffe://..." URI SAN or a plain Common
+	// Name. Only enforced when tls.client_auth verifies client certs.
+	RequiredClientIdentity string `yaml:"required_client_identity"`
 }
 
 func loadConfig(path string) (*Config, error) {
@@ -46,6 +120,27 @@ func maskToken(t string) string {
 	return t[:12] + "..." + t[len(t)-6:]
 }
 
+// statusWriter wraps http.ResponseWriter to capture the status code written
+// by the proxy, so it can be recorded in metrics and the audit log after
+// ServeHTTP returns.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush forwards to the underlying ResponseWriter's Flusher, if any, so
+// streamed (SSE) responses are still flushed chunk-by-chunk to the client.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func main() {
 	configPath := flag.String("config", "config.yaml", "path to config file")
 	logLevel := flag.String("log-level", "info", "log level: debug, info, warn, error")
@@ -59,6 +154,10 @@ func main() {
 	log := zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.DateTime}).
 		With().Timestamp().Logger().Level(level)
 
+	// auditLog emits one structured JSON line per completed request, separate
+	// from the human-readable console log, so it can be shipped to Loki/ELK.
+	auditLog := zerolog.New(os.Stdout).With().Timestamp().Logger()
+
 	cfg, err := loadConfig(*configPath)
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to load config")
@@ -68,22 +167,88 @@ func main() {
 		log.Fatal().Msg("oauth_token is required in config")
 	}
 
-	validKeys := make(map[string]bool, len(cfg.VirtualKeys))
-	for _, k := range cfg.VirtualKeys {
-		validKeys[k] = true
+	tlsConfig, err := buildTLSConfig(cfg.TLS)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid tls config")
+	}
+
+	appCtx := context.Background()
+
+	keyStore, err := newKeyStore(appCtx, cfg, *configPath, log)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to initialize key store")
 	}
+	policies := newPolicyRegistry(appCtx, keyStore, log)
 
 	upstream, err := url.Parse(cfg.Upstream)
 	if err != nil {
 		log.Fatal().Err(err).Str("upstream", cfg.Upstream).Msg("invalid upstream URL")
 	}
 
-	oauthToken := cfg.OAuthToken
+	tokenSources := make(map[string]*TokenSource, len(cfg.UpstreamAccounts)+1)
+	tokenSources[""] = NewTokenSource("", oauthCreds{
+		OAuthToken:    cfg.OAuthToken,
+		RefreshToken:  cfg.RefreshToken,
+		ClientID:      cfg.ClientID,
+		TokenEndpoint: cfg.TokenEndpoint,
+		ExpiresAt:     cfg.ExpiresAt,
+	}, *configPath, log)
+	for name, account := range cfg.UpstreamAccounts {
+		tokenSources[name] = NewTokenSource(name, oauthCreds{
+			OAuthToken:    account.OAuthToken,
+			RefreshToken:  account.RefreshToken,
+			ClientID:      account.ClientID,
+			TokenEndpoint: account.TokenEndpoint,
+			ExpiresAt:     account.ExpiresAt,
+		}, *configPath, log)
+	}
+	for _, ts := range tokenSources {
+		go ts.RunBackgroundRefresh(appCtx)
+	}
+
+	metrics := NewMetrics()
+	usageRecorder := newUsageRecorder(metrics)
+	if cfg.PrometheusAddr != "" {
+		go func() {
+			log.Info().Str("addr", cfg.PrometheusAddr).Msg("serving prometheus metrics")
+			if err := metrics.Serve(cfg.PrometheusAddr); err != nil {
+				log.Error().Err(err).Msg("metrics server stopped")
+			}
+		}()
+	}
+
+	if cfg.AdminAddr != "" {
+		adminStore, ok := keyStore.(*adminStore)
+		if !ok {
+			log.Fatal().Msg("admin_addr requires key_store.type \"static\" (or unset)")
+		}
+		adminTLSConfig, err := buildTLSConfig(cfg.AdminTLS)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid admin_tls config")
+		}
+		admin := &adminServer{store: adminStore, policies: policies, metrics: metrics}
+		go func() {
+			if adminTLSConfig != nil {
+				srv := &http.Server{Addr: cfg.AdminAddr, Handler: admin.Handler(cfg.AdminSharedSecret), TLSConfig: adminTLSConfig}
+				log.Info().Str("addr", cfg.AdminAddr).Msg("serving admin api and ui (tls)")
+				if err := srv.ListenAndServeTLS("", ""); err != nil {
+					log.Error().Err(err).Msg("admin server stopped")
+				}
+				return
+			}
+			log.Info().Str("addr", cfg.AdminAddr).Msg("serving admin api and ui")
+			if err := http.ListenAndServe(cfg.AdminAddr, admin.Handler(cfg.AdminSharedSecret)); err != nil {
+				log.Error().Err(err).Msg("admin server stopped")
+			}
+		}()
+	}
+
 	log.Info().
 		Int("port", cfg.Port).
 		Str("upstream", cfg.Upstream).
-		Int("virtual_keys", len(validKeys)).
-		Str("oauth_token", maskToken(oauthToken)).
+		Str("key_store", defaultKeyStoreType(cfg.KeyStore.Type)).
+		Int("upstream_accounts", len(cfg.UpstreamAccounts)).
+		Str("oauth_token", maskToken(cfg.OAuthToken)).
 		Msg("starting maxmux")
 
 	proxy := &httputil.ReverseProxy{
@@ -92,7 +257,14 @@ func main() {
 			req.URL.Host = upstream.Host
 			req.Host = upstream.Host
 
-			// Replace virtual key with real OAuth token in Authorization header.
+			// Replace the virtual key with the upstream OAuth token the
+			// handler fetched. It travels via the request context rather
+			// than a header so it never shows up in the generic
+			// header-dump below.
+			var oauthToken string
+			if info, ok := req.Context().Value(reqInfoContextKey).(*reqInfo); ok {
+				oauthToken = info.token
+			}
 			req.Header.Set("Authorization", "Bearer "+oauthToken)
 
 			// Remove x-api-key if present — OAuth uses Authorization, not x-api-key.
@@ -113,8 +285,37 @@ func main() {
 		},
 		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
 			log.Error().Err(err).Str("method", r.Method).Str("path", r.URL.Path).Msg("upstream error")
+			metrics.UpstreamErrorsTotal.Inc()
 			http.Error(w, `{"error":{"message":"upstream error","type":"proxy_error"}}`, http.StatusBadGateway)
 		},
+		ModifyResponse: func(resp *http.Response) error {
+			info, _ := resp.Request.Context().Value(reqInfoContextKey).(*reqInfo)
+			if info == nil {
+				return nil
+			}
+
+			onUsage := func(u usage) {
+				info.usage = u
+				usageRecorder.RecordUsage(info.state, info.model, u)
+			}
+
+			contentType := resp.Header.Get("Content-Type")
+			switch {
+			case strings.HasPrefix(contentType, "text/event-stream"):
+				resp.Body = newSSEUsageReader(resp.Body, onUsage)
+			case strings.HasPrefix(contentType, "application/json"):
+				body, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil {
+					return fmt.Errorf("reading upstream response: %w", err)
+				}
+				if u, ok := parseJSONUsage(body); ok {
+					onUsage(u)
+				}
+				resp.Body = io.NopCloser(bytes.NewReader(body))
+			}
+			return nil
+		},
 	}
 
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -126,19 +327,94 @@ func main() {
 			virtualKey = strings.TrimPrefix(auth, "Bearer ")
 		}
 
-		if !validKeys[virtualKey] {
+		state, ok := policies.Lookup(hashKey(virtualKey))
+		if !ok {
 			log.Warn().
 				Str("method", r.Method).
 				Str("path", r.URL.Path).
 				Str("remote", r.RemoteAddr).
 				Msg("rejected — invalid virtual key")
+			metrics.RejectedTotal.WithLabelValues("invalid_key").Inc()
 			http.Error(w, `{"error":{"message":"invalid virtual key","type":"authentication_error"}}`, http.StatusUnauthorized)
 			return
 		}
 
+		// Client-certificate pinning is enforced as soon as the key is known,
+		// ahead of rate limiting, budget, and model checks.
+		if !clientIdentityMatches(r, state.RequiredClientIdentity) {
+			log.Warn().Str("virtual_key", state.Name).Msg("rejected — client certificate does not match required identity")
+			metrics.RejectedTotal.WithLabelValues("client_identity_mismatch").Inc()
+			http.Error(w, `{"error":{"message":"client certificate does not match required identity","type":"authentication_error"}}`, http.StatusForbidden)
+			return
+		}
+
+		if !state.allowRate() {
+			log.Warn().Str("virtual_key", state.Name).Msg("rejected — rate limit exceeded")
+			metrics.RejectedTotal.WithLabelValues("rate_limited").Inc()
+			http.Error(w, `{"error":{"message":"rate limit exceeded","type":"rate_limit_error"}}`, http.StatusTooManyRequests)
+			return
+		}
+
+		if !state.hasBudget() {
+			log.Warn().Str("virtual_key", state.Name).Msg("rejected — daily token budget exhausted")
+			metrics.RejectedTotal.WithLabelValues("budget_exhausted").Inc()
+			http.Error(w, `{"error":{"message":"daily token budget exhausted","type":"rate_limit_error"}}`, http.StatusTooManyRequests)
+			return
+		}
+
+		bodyBytes, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			log.Error().Err(err).Msg("failed to read request body")
+			metrics.RejectedTotal.WithLabelValues("body_read_error").Inc()
+			http.Error(w, `{"error":{"message":"failed to read request body","type":"invalid_request_error"}}`, http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+		r.ContentLength = int64(len(bodyBytes))
+
+		var peek struct {
+			Model string `json:"model"`
+		}
+		isJSON := json.Unmarshal(bodyBytes, &peek) == nil // non-JSON bodies leave peek.Model == "", which allowModel rejects for a key with a configured allow-list
+
+		if isJSON && log.GetLevel() <= zerolog.DebugLevel {
+			debugBody := bodyBytes
+			if cfg.RedactSystemPrompts {
+				debugBody = redactSystemPrompt(bodyBytes)
+			}
+			log.Debug().Str("virtual_key", state.Name).RawJSON("body", debugBody).Msg("request body")
+		}
+
+		if !state.allowModel(peek.Model) {
+			log.Warn().Str("virtual_key", state.Name).Str("model", peek.Model).Msg("rejected — model not allowed")
+			metrics.RejectedTotal.WithLabelValues("model_not_allowed").Inc()
+			http.Error(w, `{"error":{"message":"model not allowed for this virtual key","type":"permission_error"}}`, http.StatusForbidden)
+			return
+		}
+
+		tokenSource, ok := tokenSources[state.UpstreamAccount]
+		if !ok {
+			log.Error().Str("virtual_key", state.Name).Str("upstream_account", state.UpstreamAccount).
+				Msg("no token source for upstream account")
+			http.Error(w, `{"error":{"message":"upstream authentication unavailable","type":"proxy_error"}}`, http.StatusBadGateway)
+			return
+		}
+
+		token, err := tokenSource.Get(r.Context())
+		if err != nil {
+			log.Error().Err(err).Msg("failed to obtain upstream oauth token")
+			http.Error(w, `{"error":{"message":"upstream authentication unavailable","type":"proxy_error"}}`, http.StatusBadGateway)
+			return
+		}
+
+		info := &reqInfo{state: state, model: peek.Model, token: token}
+		r = r.WithContext(context.WithValue(r.Context(), reqInfoContextKey, info))
+
 		log.Info().
 			Str("method", r.Method).
 			Str("path", r.URL.Path).
+			Str("virtual_key", state.Name).
 			Msg("forwarding")
 
 		// Log all headers at debug level.
@@ -152,16 +428,40 @@ func main() {
 			}
 		}
 
-		proxy.ServeHTTP(w, r)
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		proxy.ServeHTTP(sw, r)
+		duration := time.Since(start)
 
 		log.Info().
 			Str("method", r.Method).
 			Str("path", r.URL.Path).
-			Dur("duration", time.Since(start)).
+			Dur("duration", duration).
 			Msg("completed")
+
+		status := strconv.Itoa(sw.status)
+		metrics.RequestsTotal.WithLabelValues(state.Name, r.Method, r.URL.Path, status).Inc()
+		metrics.RequestDuration.WithLabelValues(state.Name, r.Method, r.URL.Path).Observe(duration.Seconds())
+
+		auditLog.Info().
+			Str("virtual_key", state.Name).
+			Str("model", info.model).
+			Int("status", sw.status).
+			Int("input_tokens", info.usage.InputTokens).
+			Int("output_tokens", info.usage.OutputTokens).
+			Dur("duration", duration).
+			Msg("request completed")
 	})
 
 	addr := fmt.Sprintf(":%d", cfg.Port)
+	if tlsConfig != nil {
+		srv := &http.Server{Addr: addr, Handler: handler, TLSConfig: tlsConfig}
+		log.Info().Str("addr", addr).Msg("listening (tls)")
+		if err := srv.ListenAndServeTLS("", ""); err != nil {
+			log.Fatal().Err(err).Msg("server error")
+		}
+		return
+	}
+
 	log.Info().Str("addr", addr).Msg("listening")
 	if err := http.ListenAndServe(addr, handler); err != nil {
 		log.Fatal().Err(err).Msg("server error")
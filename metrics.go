@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds every Prometheus collector maxmux exposes on its
+// prometheus_addr listener.
+type Metrics struct {
+	RequestsTotal       *prometheus.CounterVec
+	RequestDuration     *prometheus.HistogramVec
+	UpstreamErrorsTotal prometheus.Counter
+	RejectedTotal       *prometheus.CounterVec
+	TokensUsedTotal     *prometheus.CounterVec
+}
+
+// NewMetrics registers and returns maxmux's collectors against the default
+// Prometheus registry.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		RequestsTotal: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "maxmux_requests_total",
+			Help: "Total number of proxied requests, by virtual key, method, path, and response status.",
+		}, []string{"virtual_key", "method", "path", "status"}),
+		RequestDuration: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "maxmux_request_duration_seconds",
+			Help:    "Request duration in seconds, from the first byte in to the last byte out.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"virtual_key", "method", "path"}),
+		UpstreamErrorsTotal: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "maxmux_upstream_errors_total",
+			Help: "Total number of requests that failed to reach or receive a response from upstream.",
+		}),
+		RejectedTotal: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "maxmux_rejected_total",
+			Help: "Total number of requests rejected before being forwarded upstream, by reason.",
+		}, []string{"reason"}),
+		TokensUsedTotal: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "maxmux_tokens_used_total",
+			Help: "Total number of tokens billed against a virtual key, scraped from upstream usage responses.",
+		}, []string{"virtual_key", "model", "kind"}),
+	}
+}
+
+// Serve starts the metrics endpoint on its own listener so scraping it never
+// competes with, or is gated behind auth for, the proxied API.
+func (m *Metrics) Serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return http.ListenAndServe(addr, mux)
+}
+
+// TokensUsedFor sums maxmux_tokens_used_total for virtualKey across every
+// model, split by input/output, by reading the counter back from the
+// registry — the same numbers promhttp.Handler would export. Used by the
+// admin API so its usage stats come from the same counters as /metrics.
+func (m *Metrics) TokensUsedFor(virtualKey string) (input, output float64) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return 0, 0
+	}
+	for _, family := range families {
+		if family.GetName() != "maxmux_tokens_used_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			var key, kind string
+			for _, label := range metric.GetLabel() {
+				switch label.GetName() {
+				case "virtual_key":
+					key = label.GetValue()
+				case "kind":
+					kind = label.GetValue()
+				}
+			}
+			if key != virtualKey {
+				continue
+			}
+			switch kind {
+			case "input":
+				input += metric.GetCounter().GetValue()
+			case "output":
+				output += metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return input, output
+}
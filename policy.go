@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// contextKey namespaces values maxmux stashes on a request context so they
+// don't collide with keys set by net/http or other packages.
+type contextKey int
+
+// reqInfoContextKey is how the handler hands the resolved virtual key,
+// requested model, and fetched upstream OAuth token off to the proxy's
+// Director and ModifyResponse hooks.
+const reqInfoContextKey contextKey = iota
+
+// reqInfo carries per-request bookkeeping from the handler through to the
+// proxy's Director (which needs token to authenticate upstream) and
+// ModifyResponse (where the upstream usage numbers become available). It's
+// threaded through the request context rather than a request header so it
+// never risks being logged or forwarded upstream by code that just iterates
+// r.Header.
+type reqInfo struct {
+	state *keyState
+	model string
+	token string
+	usage usage
+}
+
+// usageHistoryDays is how many trailing days of token usage each keyState
+// keeps around, for the admin UI's per-key sparkline.
+const usageHistoryDays = 7
+
+// keyState is the runtime-mutable counterpart to a configured VirtualKey:
+// the static policy plus its in-process rate limiter, daily token budget,
+// and a rolling window of daily usage totals.
+type keyState struct {
+	VirtualKey
+
+	limiter *rateLimiter
+
+	mu      sync.Mutex
+	history [usageHistoryDays]dayUsage
+}
+
+// dayUsage is one slot of a keyState's usage ring buffer: the tokens used on
+// date (an UTC "2006-01-02" label), or a stale slot being reused for a new
+// day once date no longer matches.
+type dayUsage struct {
+	date  string
+	total int
+}
+
+func newKeyState(vk VirtualKey) *keyState {
+	ks := &keyState{VirtualKey: vk}
+	if vk.RequestsPerMinute > 0 {
+		ks.limiter = newRateLimiter(vk.RequestsPerMinute)
+	}
+	return ks
+}
+
+// allowModel reports whether model is permitted by this key's allow-list. An
+// empty allow-list permits every model. A key with a configured allow-list
+// rejects requests whose model couldn't be determined (model == ""), since
+// an unidentifiable model can't be checked against the list.
+func (ks *keyState) allowModel(model string) bool {
+	if len(ks.AllowedModels) == 0 {
+		return true
+	}
+	if model == "" {
+		return false
+	}
+	for _, m := range ks.AllowedModels {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
+
+// allowRate reports whether this key is within its RequestsPerMinute limit.
+func (ks *keyState) allowRate() bool {
+	if ks.limiter == nil {
+		return true
+	}
+	return ks.limiter.Allow()
+}
+
+// hasBudget reports whether this key still has daily token budget left.
+func (ks *keyState) hasBudget() bool {
+	if ks.DailyTokenBudget <= 0 {
+		return true
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	idx := ks.todaySlotLocked(time.Now().UTC())
+	return ks.history[idx].total < ks.DailyTokenBudget
+}
+
+// chargeUsage records the tokens an upstream response reported using against
+// today's slot in the usage history, which both enforces DailyTokenBudget
+// and feeds the admin UI's per-key sparkline.
+func (ks *keyState) chargeUsage(u usage) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	idx := ks.todaySlotLocked(time.Now().UTC())
+	ks.history[idx].total += u.InputTokens + u.OutputTokens
+}
+
+// todaySlotLocked returns the ring-buffer index for now, resetting it first
+// if it was last used for a different day.
+func (ks *keyState) todaySlotLocked(now time.Time) int {
+	idx := int(now.Unix()/86400) % usageHistoryDays
+	today := now.Format("2006-01-02")
+	if ks.history[idx].date != today {
+		ks.history[idx] = dayUsage{date: today}
+	}
+	return idx
+}
+
+// usageHistory returns the last usageHistoryDays of token usage for this
+// key, oldest first. Days with no recorded slot (never used, or bumped out
+// of the ring buffer) report zero.
+func (ks *keyState) usageHistory() []int {
+	now := time.Now().UTC()
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	out := make([]int, usageHistoryDays)
+	for i := range out {
+		day := now.AddDate(0, 0, -(usageHistoryDays - 1 - i))
+		idx := int(day.Unix()/86400) % usageHistoryDays
+		if ks.history[idx].date == day.Format("2006-01-02") {
+			out[i] = ks.history[idx].total
+		}
+	}
+	return out
+}
+
+// policyRegistry adapts a KeyStore — which only knows about the static
+// VirtualKey policy — into long-lived *keyState values that also carry a
+// rate limiter and budget counter. It evicts the cached state for a key as
+// soon as the store reports that key's hash changed, so a rotation or quota
+// edit for one key is picked up without restarting maxmux and without
+// resetting the rate/budget counters of every other, unrelated key.
+type policyRegistry struct {
+	store KeyStore
+	log   zerolog.Logger
+
+	mu     sync.Mutex
+	states map[string]*keyState
+}
+
+func newPolicyRegistry(ctx context.Context, store KeyStore, log zerolog.Logger) *policyRegistry {
+	r := &policyRegistry{store: store, log: log, states: make(map[string]*keyState)}
+	go r.watch(ctx)
+	return r
+}
+
+func (r *policyRegistry) watch(ctx context.Context) {
+	signal := r.store.Watch(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-signal:
+			if !ok {
+				return
+			}
+			hashes, all := r.store.Drain()
+			r.mu.Lock()
+			if all {
+				r.states = make(map[string]*keyState)
+			} else {
+				for _, hash := range hashes {
+					delete(r.states, hash)
+				}
+			}
+			r.mu.Unlock()
+			r.log.Debug().Strs("key_hashes", hashes).Bool("flushed_all", all).
+				Msg("key policy changed; will be refreshed on next use")
+		}
+	}
+}
+
+// Lookup resolves keyHash to its running keyState, fetching and caching the
+// policy from the store on first use.
+func (r *policyRegistry) Lookup(keyHash string) (*keyState, bool) {
+	r.mu.Lock()
+	if ks, ok := r.states[keyHash]; ok {
+		r.mu.Unlock()
+		return ks, true
+	}
+	r.mu.Unlock()
+
+	vk, ok := r.store.Lookup(keyHash)
+	if !ok {
+		return nil, false
+	}
+
+	ks := newKeyState(vk)
+	r.mu.Lock()
+	r.states[keyHash] = ks
+	r.mu.Unlock()
+	return ks, true
+}
@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+func TestKeyStateAllowModel(t *testing.T) {
+	tests := []struct {
+		name          string
+		allowedModels []string
+		model         string
+		want          bool
+	}{
+		{"empty allow-list permits any model", nil, "claude-3-opus", true},
+		{"empty allow-list permits unidentified model", nil, "", true},
+		{"allowed model passes", []string{"claude-3-opus", "claude-3-haiku"}, "claude-3-haiku", true},
+		{"disallowed model is rejected", []string{"claude-3-opus"}, "claude-3-sonnet", false},
+		{"configured allow-list rejects an unidentified model", []string{"claude-3-opus"}, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ks := newKeyState(VirtualKey{AllowedModels: tt.allowedModels})
+			if got := ks.allowModel(tt.model); got != tt.want {
+				t.Errorf("allowModel(%q) with AllowedModels=%v = %v, want %v", tt.model, tt.allowedModels, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyStateHasBudget(t *testing.T) {
+	t.Run("no budget configured always allows", func(t *testing.T) {
+		ks := newKeyState(VirtualKey{DailyTokenBudget: 0})
+		ks.chargeUsage(usage{InputTokens: 1_000_000, OutputTokens: 1_000_000})
+		if !ks.hasBudget() {
+			t.Error("hasBudget() = false, want true when DailyTokenBudget is unset")
+		}
+	})
+
+	t.Run("usage under budget allows", func(t *testing.T) {
+		ks := newKeyState(VirtualKey{DailyTokenBudget: 100})
+		ks.chargeUsage(usage{InputTokens: 40, OutputTokens: 10})
+		if !ks.hasBudget() {
+			t.Error("hasBudget() = false, want true when usage is under budget")
+		}
+	})
+
+	t.Run("usage at or over budget rejects", func(t *testing.T) {
+		ks := newKeyState(VirtualKey{DailyTokenBudget: 100})
+		ks.chargeUsage(usage{InputTokens: 60, OutputTokens: 40})
+		if ks.hasBudget() {
+			t.Error("hasBudget() = true, want false once usage reaches DailyTokenBudget")
+		}
+	})
+
+	t.Run("chargeUsage accumulates across calls", func(t *testing.T) {
+		ks := newKeyState(VirtualKey{DailyTokenBudget: 100})
+		ks.chargeUsage(usage{InputTokens: 30, OutputTokens: 0})
+		ks.chargeUsage(usage{InputTokens: 0, OutputTokens: 50})
+		if !ks.hasBudget() {
+			t.Error("hasBudget() = false after 80/100 tokens charged, want true")
+		}
+		ks.chargeUsage(usage{InputTokens: 20, OutputTokens: 0})
+		if ks.hasBudget() {
+			t.Error("hasBudget() = true after 100/100 tokens charged, want false")
+		}
+	})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a simple in-process token bucket used to enforce a virtual
+// key's RequestsPerMinute limit.
+type rateLimiter struct {
+	mu         sync.Mutex
+	tokens     float64
+	max        float64
+	refillRate float64 // tokens per second
+	last       time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	rate := float64(perMinute) / 60.0
+	return &rateLimiter{
+		tokens:     float64(perMinute),
+		max:        float64(perMinute),
+		refillRate: rate,
+		last:       time.Now(),
+	}
+}
+
+// Allow reports whether a request may proceed, consuming one token if so.
+func (l *rateLimiter) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.refillRate
+	if l.tokens > l.max {
+		l.tokens = l.max
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestRateLimiterAllowsBurstUpToMax(t *testing.T) {
+	l := newRateLimiter(3)
+
+	for i := 0; i < 3; i++ {
+		if !l.Allow() {
+			t.Fatalf("Allow() #%d = false, want true within the initial burst of 3", i+1)
+		}
+	}
+	if l.Allow() {
+		t.Error("Allow() after exhausting the burst = true, want false")
+	}
+}
+
+func TestRateLimiterZeroPerMinuteNeverAllows(t *testing.T) {
+	l := newRateLimiter(0)
+	if l.Allow() {
+		t.Error("Allow() with 0 requests per minute = true, want false")
+	}
+}
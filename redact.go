@@ -0,0 +1,23 @@
+package main
+
+import "encoding/json"
+
+// redactSystemPrompt returns body with its top-level "system" field replaced
+// by a placeholder, for debug logs when redact_system_prompts is enabled. If
+// body isn't a JSON object, or has no "system" field, it's returned as-is.
+func redactSystemPrompt(body []byte) []byte {
+	var payload map[string]json.RawMessage
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return body
+	}
+	if _, ok := payload["system"]; !ok {
+		return body
+	}
+
+	payload["system"] = json.RawMessage(`"[redacted]"`)
+	redacted, err := json.Marshal(payload)
+	if err != nil {
+		return body
+	}
+	return redacted
+}
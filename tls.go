@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// TLSConfig configures TLS termination on the proxy listener, including
+// optional mTLS client certificate verification.
+type TLSConfig struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file"`
+	// ClientAuth is one of "none", "request", "require", "verify_if_given",
+	// or "require_and_verify". Defaults to "none".
+	ClientAuth string `yaml:"client_auth"`
+}
+
+// buildTLSConfig turns cfg into a *tls.Config ready to hand to http.Server,
+// or nil if TLS isn't configured (cfg.CertFile == "").
+func buildTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	if cfg.CertFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS certificate: %w", err)
+	}
+
+	clientAuth, err := parseClientAuthType(cfg.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   clientAuth,
+	}
+
+	if cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading client_ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client_ca_file %q", cfg.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+func parseClientAuthType(s string) (tls.ClientAuthType, error) {
+	switch s {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.RequestClientCert, nil
+	case "require":
+		return tls.RequireAnyClientCert, nil
+	case "verify_if_given":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require_and_verify":
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return 0, fmt.Errorf("unknown tls.client_auth %q", s)
+	}
+}
+
+// clientIdentityMatches reports whether r's verified client certificate (if
+// any) satisfies required, which is either a SPIFFE-style "spiffe://..."
+// URI SAN or a plain Common Name. An empty required matches anything.
+func clientIdentityMatches(r *http.Request, required string) bool {
+	if required == "" {
+		return true
+	}
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return false
+	}
+	leaf := r.TLS.PeerCertificates[0]
+
+	if strings.HasPrefix(required, "spiffe://") {
+		for _, uri := range leaf.URIs {
+			if uri.String() == required {
+				return true
+			}
+		}
+		return false
+	}
+
+	return leaf.Subject.CommonName == required
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// tokenRefreshSkew is how long before expiry a cached access token is
+// considered stale, both for synchronous Get calls and for scheduling the
+// background refresh.
+const tokenRefreshSkew = 60 * time.Second
+
+// TokenSource holds the current OAuth access token and refreshes it against
+// tokenEndpoint using the refresh_token grant before it expires.
+type TokenSource struct {
+	mu sync.Mutex
+
+	accessToken   string
+	refreshToken  string
+	expiresAt     time.Time
+	clientID      string
+	tokenEndpoint string
+
+	tokensPath string
+	httpClient *http.Client
+	log        zerolog.Logger
+}
+
+// oauthCreds is the set of OAuth fields shared by the top-level Config and
+// by each entry in Config.UpstreamAccounts.
+type oauthCreds struct {
+	OAuthToken    string
+	RefreshToken  string
+	ClientID      string
+	TokenEndpoint string
+	ExpiresAt     time.Time
+}
+
+// NewTokenSource builds a TokenSource for one upstream account (account is
+// "" for the default, top-level account), seeding it with any rotated
+// tokens a previous run left behind in that account's sidecar tokens file.
+func NewTokenSource(account string, creds oauthCreds, configPath string, log zerolog.Logger) *TokenSource {
+	ts := &TokenSource{
+		accessToken:   creds.OAuthToken,
+		refreshToken:  creds.RefreshToken,
+		expiresAt:     creds.ExpiresAt,
+		clientID:      creds.ClientID,
+		tokenEndpoint: creds.TokenEndpoint,
+		tokensPath:    tokensSidecarPath(configPath, account),
+		httpClient:    &http.Client{Timeout: 10 * time.Second},
+		log:           log.With().Str("upstream_account", defaultAccountLabel(account)).Logger(),
+	}
+
+	saved, err := loadTokensSidecar(ts.tokensPath)
+	switch {
+	case err == nil:
+		ts.accessToken = saved.OAuthToken
+		ts.refreshToken = saved.RefreshToken
+		ts.expiresAt = saved.ExpiresAt
+	case !os.IsNotExist(err):
+		log.Warn().Err(err).Str("path", ts.tokensPath).Msg("ignoring unreadable tokens sidecar")
+	}
+
+	return ts
+}
+
+func defaultAccountLabel(account string) string {
+	if account == "" {
+		return "default"
+	}
+	return account
+}
+
+// Get returns a valid access token, refreshing it first if it is within
+// tokenRefreshSkew of expiring. A token with a zero expiry is treated as
+// static and never refreshed.
+func (ts *TokenSource) Get(ctx context.Context) (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.expiresAt.IsZero() || time.Until(ts.expiresAt) > tokenRefreshSkew {
+		return ts.accessToken, nil
+	}
+	if err := ts.refreshLocked(ctx); err != nil {
+		return "", err
+	}
+	return ts.accessToken, nil
+}
+
+// RunBackgroundRefresh proactively refreshes the token tokenRefreshSkew
+// before it expires so interactive requests never pay the refresh latency.
+// It returns once ctx is canceled, or immediately for a static token.
+func (ts *TokenSource) RunBackgroundRefresh(ctx context.Context) {
+	for {
+		ts.mu.Lock()
+		expiresAt := ts.expiresAt
+		ts.mu.Unlock()
+
+		if expiresAt.IsZero() {
+			return
+		}
+
+		wait := time.Until(expiresAt) - tokenRefreshSkew
+		if wait < 0 {
+			wait = 0
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		ts.mu.Lock()
+		err := ts.refreshLocked(ctx)
+		ts.mu.Unlock()
+		if err != nil {
+			ts.log.Error().Err(err).Msg("background oauth token refresh failed")
+		}
+	}
+}
+
+// refreshLocked performs the refresh_token grant and swaps in the new
+// access/refresh tokens. Callers must hold ts.mu.
+func (ts *TokenSource) refreshLocked(ctx context.Context) error {
+	if ts.refreshToken == "" || ts.tokenEndpoint == "" {
+		return fmt.Errorf("oauth token expired and no refresh_token/token_endpoint configured")
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {ts.refreshToken},
+	}
+	if ts.clientID != "" {
+		form.Set("client_id", ts.clientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ts.tokenEndpoint, bytes.NewBufferString(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("building refresh request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := ts.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("refreshing oauth token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("reading refresh response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("refresh endpoint returned %d: %s", resp.StatusCode, body)
+	}
+
+	var payload struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return fmt.Errorf("parsing refresh response: %w", err)
+	}
+	if payload.AccessToken == "" {
+		return fmt.Errorf("refresh response missing access_token")
+	}
+
+	ts.accessToken = payload.AccessToken
+	if payload.RefreshToken != "" {
+		ts.refreshToken = payload.RefreshToken
+	}
+	if payload.ExpiresIn > 0 {
+		ts.expiresAt = time.Now().Add(time.Duration(payload.ExpiresIn) * time.Second)
+	}
+
+	if err := ts.persistLocked(); err != nil {
+		ts.log.Error().Err(err).Str("path", ts.tokensPath).Msg("failed to persist refreshed oauth tokens")
+	}
+
+	ts.log.Info().Time("expires_at", ts.expiresAt).Msg("refreshed oauth access token")
+	return nil
+}
+
+// tokensSidecar is the on-disk shape of the tokens.json file written next to
+// the config so a restart doesn't lose a rotated refresh_token.
+type tokensSidecar struct {
+	OAuthToken   string    `json:"oauth_token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+func tokensSidecarPath(configPath, account string) string {
+	if account == "" {
+		return filepath.Join(filepath.Dir(configPath), "tokens.json")
+	}
+	return filepath.Join(filepath.Dir(configPath), fmt.Sprintf("tokens.%s.json", account))
+}
+
+func loadTokensSidecar(path string) (*tokensSidecar, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var saved tokensSidecar
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("parsing tokens sidecar: %w", err)
+	}
+	return &saved, nil
+}
+
+// persistLocked writes the current tokens to disk. Callers must hold ts.mu.
+func (ts *TokenSource) persistLocked() error {
+	data, err := json.MarshalIndent(tokensSidecar{
+		OAuthToken:   ts.accessToken,
+		RefreshToken: ts.refreshToken,
+		ExpiresAt:    ts.expiresAt,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling tokens sidecar: %w", err)
+	}
+	return os.WriteFile(ts.tokensPath, data, 0o600)
+}
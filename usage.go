@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// usage is the token accounting extracted from an upstream Anthropic response.
+type usage struct {
+	InputTokens  int
+	OutputTokens int
+}
+
+// UsageRecorder records the token usage parsed from an upstream response
+// against the virtual key that made the request. ModifyResponse calls it
+// exactly once per request (or once per stream, at the end), so the same
+// parsing code in this file can drive both Prometheus metrics and per-key
+// DailyTokenBudget enforcement without either being hard-coded into the
+// parser.
+type UsageRecorder interface {
+	RecordUsage(state *keyState, model string, u usage)
+}
+
+// metricsUsageRecorder is maxmux's only UsageRecorder: it charges the key's
+// daily budget and reports the same numbers to Prometheus.
+type metricsUsageRecorder struct {
+	metrics *Metrics
+}
+
+// newUsageRecorder builds maxmux's UsageRecorder on top of the shared
+// Metrics registry.
+func newUsageRecorder(metrics *Metrics) UsageRecorder {
+	return &metricsUsageRecorder{metrics: metrics}
+}
+
+func (r *metricsUsageRecorder) RecordUsage(state *keyState, model string, u usage) {
+	state.chargeUsage(u)
+	r.metrics.TokensUsedTotal.WithLabelValues(state.Name, model, "input").Add(float64(u.InputTokens))
+	r.metrics.TokensUsedTotal.WithLabelValues(state.Name, model, "output").Add(float64(u.OutputTokens))
+}
+
+// parseJSONUsage extracts the top-level "usage" object from a non-streaming
+// JSON response body. ok is false if the body carries no usage information.
+func parseJSONUsage(body []byte) (u usage, ok bool) {
+	var payload struct {
+		Usage struct {
+			InputTokens  int `json:"input_tokens"`
+			OutputTokens int `json:"output_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return usage{}, false
+	}
+	if payload.Usage.InputTokens == 0 && payload.Usage.OutputTokens == 0 {
+		return usage{}, false
+	}
+	return usage{InputTokens: payload.Usage.InputTokens, OutputTokens: payload.Usage.OutputTokens}, true
+}
+
+// sseUsageReader wraps a text/event-stream response body, forwarding bytes
+// to the client unchanged while accumulating the usage reported by the
+// message_start and message_delta events. onDone fires once, with the final
+// totals, when the stream ends.
+type sseUsageReader struct {
+	body     io.ReadCloser
+	leftover []byte
+	usage    usage
+	onDone   func(usage)
+	done     bool
+	event    string // most recent "event: ..." line, cleared once its data line is consumed
+}
+
+func newSSEUsageReader(body io.ReadCloser, onDone func(usage)) *sseUsageReader {
+	return &sseUsageReader{body: body, onDone: onDone}
+}
+
+func (r *sseUsageReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if n > 0 {
+		r.leftover = append(r.leftover, p[:n]...)
+		r.consumeLines()
+	}
+	if err != nil {
+		r.finish()
+	}
+	return n, err
+}
+
+func (r *sseUsageReader) Close() error {
+	r.finish()
+	return r.body.Close()
+}
+
+func (r *sseUsageReader) consumeLines() {
+	for {
+		idx := bytes.IndexByte(r.leftover, '\n')
+		if idx < 0 {
+			return
+		}
+		line := bytes.TrimRight(r.leftover[:idx], "\r")
+		r.leftover = r.leftover[idx+1:]
+		r.parseLine(line)
+	}
+}
+
+func (r *sseUsageReader) parseLine(line []byte) {
+	const eventPrefix = "event: "
+	const dataPrefix = "data: "
+
+	if bytes.HasPrefix(line, []byte(eventPrefix)) {
+		r.event = string(line[len(eventPrefix):])
+		return
+	}
+	if !bytes.HasPrefix(line, []byte(dataPrefix)) {
+		return
+	}
+	// Every data: line ends its event block; only message_start and
+	// message_delta ever carry usage, so skip parsing the rest (ping,
+	// content_block_delta, ...) entirely.
+	event := r.event
+	r.event = ""
+	if event != "message_start" && event != "message_delta" {
+		return
+	}
+
+	var payload struct {
+		Usage struct {
+			InputTokens  int `json:"input_tokens"`
+			OutputTokens int `json:"output_tokens"`
+		} `json:"usage"`
+		Message struct {
+			Usage struct {
+				InputTokens  int `json:"input_tokens"`
+				OutputTokens int `json:"output_tokens"`
+			} `json:"usage"`
+		} `json:"message"`
+	}
+	if err := json.Unmarshal(line[len(dataPrefix):], &payload); err != nil {
+		return
+	}
+
+	if v := payload.Message.Usage.InputTokens; v > r.usage.InputTokens {
+		r.usage.InputTokens = v
+	}
+	if v := payload.Usage.InputTokens; v > r.usage.InputTokens {
+		r.usage.InputTokens = v
+	}
+	if v := payload.Usage.OutputTokens; v > r.usage.OutputTokens {
+		r.usage.OutputTokens = v
+	}
+}
+
+func (r *sseUsageReader) finish() {
+	if r.done {
+		return
+	}
+	r.done = true
+	if r.onDone != nil {
+		r.onDone(r.usage)
+	}
+}
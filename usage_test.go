@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParseJSONUsage(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want usage
+		ok   bool
+	}{
+		{
+			name: "usage present",
+			body: `{"usage":{"input_tokens":12,"output_tokens":34}}`,
+			want: usage{InputTokens: 12, OutputTokens: 34},
+			ok:   true,
+		},
+		{
+			name: "no usage field",
+			body: `{"id":"msg_1"}`,
+			ok:   false,
+		},
+		{
+			name: "zero usage is treated as absent",
+			body: `{"usage":{"input_tokens":0,"output_tokens":0}}`,
+			ok:   false,
+		},
+		{
+			name: "invalid json",
+			body: `not json`,
+			ok:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseJSONUsage([]byte(tt.body))
+			if ok != tt.ok {
+				t.Fatalf("parseJSONUsage(%q) ok = %v, want %v", tt.body, ok, tt.ok)
+			}
+			if ok && got != tt.want {
+				t.Errorf("parseJSONUsage(%q) = %+v, want %+v", tt.body, got, tt.want)
+			}
+		})
+	}
+}
+
+// readAllSSE drains r through small reads (to exercise Read being called
+// multiple times with partial SSE frames) and returns the final usage
+// reported to onDone.
+func readAllSSE(t *testing.T, stream string) usage {
+	t.Helper()
+
+	var got usage
+	r := newSSEUsageReader(io.NopCloser(strings.NewReader(stream)), func(u usage) {
+		got = u
+	})
+
+	buf := make([]byte, 16)
+	for {
+		_, err := r.Read(buf)
+		if err != nil {
+			break
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	return got
+}
+
+func TestSSEUsageReaderEventGatedParsing(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   usage
+	}{
+		{
+			name: "message_start and message_delta usage combine to the max seen",
+			stream: "" +
+				"event: message_start\n" +
+				`data: {"message":{"usage":{"input_tokens":10,"output_tokens":0}}}` + "\n\n" +
+				"event: content_block_delta\n" +
+				`data: {"usage":{"input_tokens":999,"output_tokens":999}}` + "\n\n" +
+				"event: message_delta\n" +
+				`data: {"usage":{"input_tokens":10,"output_tokens":5}}` + "\n\n",
+			want: usage{InputTokens: 10, OutputTokens: 5},
+		},
+		{
+			name: "non-usage events are ignored even if their data looks like usage",
+			stream: "" +
+				"event: ping\n" +
+				`data: {"usage":{"input_tokens":1000,"output_tokens":1000}}` + "\n\n",
+			want: usage{},
+		},
+		{
+			name:   "stream with no events reports zero usage",
+			stream: "",
+			want:   usage{},
+		},
+		{
+			name: "malformed data line for a usage event is skipped, not fatal",
+			stream: "" +
+				"event: message_start\n" +
+				"data: not json\n\n" +
+				"event: message_delta\n" +
+				`data: {"usage":{"input_tokens":3,"output_tokens":1}}` + "\n\n",
+			want: usage{InputTokens: 3, OutputTokens: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readAllSSE(t, tt.stream); got != tt.want {
+				t.Errorf("sseUsageReader final usage = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSSEUsageReaderOnDoneFiresOnce(t *testing.T) {
+	calls := 0
+	r := newSSEUsageReader(io.NopCloser(strings.NewReader("event: message_delta\ndata: {\"usage\":{\"input_tokens\":1,\"output_tokens\":1}}\n\n")), func(usage) {
+		calls++
+	})
+
+	buf := make([]byte, 64)
+	for {
+		if _, err := r.Read(buf); err != nil {
+			break
+		}
+	}
+	_ = r.Close()
+	_ = r.Close()
+
+	if calls != 1 {
+		t.Errorf("onDone called %d times, want exactly 1", calls)
+	}
+}